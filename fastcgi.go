@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// FastCGI record types and header layout, as defined by the FastCGI
+// specification (8-byte header: version, type, requestID, contentLength,
+// paddingLength, reserved).
+const (
+	fcgiVersion1  = 1
+	fcgiHeaderLen = 8
+	fcgiMaxChunk  = 65535
+
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiRoleResponder = 1
+)
+
+type fcgiHeader struct {
+	version       uint8
+	recType       uint8
+	requestID     uint16
+	contentLength uint16
+	paddingLength uint8
+}
+
+// fastCGITransport speaks the binary FastCGI protocol to a single backend,
+// implementing http.RoundTripper so it can be plugged into a Listener's
+// httputil.ReverseProxy in place of the default HTTP transport.
+type fastCGITransport struct {
+	network string
+	addr    string
+	root    string
+	index   string
+	envVars map[string]string
+
+	nextRequestID atomic.Uint32
+}
+
+func newFastCGITransport(network, addr, root, index string, envVars map[string]string) *fastCGITransport {
+	return &fastCGITransport{network: network, addr: addr, root: root, index: index, envVars: envVars}
+}
+
+// allocateRequestID hands out a unique, non-zero request id per call so
+// concurrent RoundTrip calls on the same transport don't collide; each call
+// still opens its own connection, so the id only needs to be unique to the
+// conn it travels over, but keeping it unique here is cheap and matches what
+// a multiplexing FastCGI client would need.
+func (t *fastCGITransport) allocateRequestID() uint16 {
+	id := uint16(t.nextRequestID.Add(1))
+	if id == 0 {
+		id = uint16(t.nextRequestID.Add(1))
+	}
+	return id
+}
+
+func (t *fastCGITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, err := net.Dial(t.network, t.addr)
+	if err != nil {
+		return nil, fmt.Errorf("fastcgi: dial %s %s: %w", t.network, t.addr, err)
+	}
+	closeConn := true
+	defer func() {
+		if closeConn {
+			conn.Close()
+		}
+	}()
+
+	fc := &fcgiConn{conn: conn, requestID: t.allocateRequestID()}
+	if err := fc.writeBeginRequest(); err != nil {
+		return nil, fmt.Errorf("fastcgi: writing begin request: %w", err)
+	}
+	if err := fc.writeParams(t.buildParams(req)); err != nil {
+		return nil, fmt.Errorf("fastcgi: writing params: %w", err)
+	}
+	if err := fc.writeStdin(req.Body); err != nil {
+		return nil, fmt.Errorf("fastcgi: writing stdin: %w", err)
+	}
+
+	resp, err := fc.readResponse(req)
+	if err != nil {
+		return nil, err
+	}
+	closeConn = false
+	resp.Body = connCloseReader{ReadCloser: resp.Body, conn: conn}
+	return resp, nil
+}
+
+// connCloseReader closes the underlying connection once the response body
+// has been fully read and closed, since each FastCGI request gets its own
+// short-lived connection.
+type connCloseReader struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (r connCloseReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.conn.Close()
+	return err
+}
+
+// buildParams derives the standard CGI/1.1 parameters from req, deriving
+// SCRIPT_FILENAME from the transport's document root and appending index
+// when the request path resolves to a directory.
+func (t *fastCGITransport) buildParams(req *http.Request) map[string]string {
+	params := make(map[string]string, len(t.envVars)+len(req.Header)+8)
+	for k, v := range t.envVars {
+		params[k] = v
+	}
+
+	scriptName := req.URL.Path
+	if scriptName == "" || strings.HasSuffix(scriptName, "/") {
+		scriptName += t.index
+	}
+	params["SCRIPT_FILENAME"] = path.Join(t.root, scriptName)
+	params["SCRIPT_NAME"] = scriptName
+	params["REQUEST_URI"] = req.URL.RequestURI()
+	params["QUERY_STRING"] = req.URL.RawQuery
+	params["REQUEST_METHOD"] = req.Method
+	params["SERVER_PROTOCOL"] = req.Proto
+	params["GATEWAY_INTERFACE"] = "CGI/1.1"
+	params["REMOTE_ADDR"] = remoteHost(req.RemoteAddr)
+
+	// Listener.direct overwrites req.Host with the backend's own address
+	// before the transport ever sees the request, stashing the original in
+	// X-Forwarded-Host, so that's what HTTP_HOST/SERVER_NAME/SERVER_PORT must
+	// be derived from instead of req.Host.
+	if host := req.Header.Get("X-Forwarded-Host"); host != "" {
+		params["HTTP_HOST"] = host
+		serverName, serverPort := host, ""
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			serverName, serverPort = h, p
+		}
+		params["SERVER_NAME"] = serverName
+		if serverPort == "" {
+			serverPort = req.Header.Get("X-Forwarded-Port")
+		}
+		if serverPort == "" {
+			if req.Header.Get("X-Forwarded-Proto") == "https" {
+				serverPort = "443"
+			} else {
+				serverPort = "80"
+			}
+		}
+		params["SERVER_PORT"] = serverPort
+	}
+
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		params["CONTENT_TYPE"] = ct
+	}
+	if req.ContentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+	for name, values := range req.Header {
+		if name == "Content-Type" || name == "Content-Length" {
+			continue
+		}
+		key := "HTTP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		params[key] = strings.Join(values, ", ")
+	}
+	return params
+}
+
+func remoteHost(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// fcgiConn frames FastCGI records for a single request over conn.
+type fcgiConn struct {
+	conn      net.Conn
+	requestID uint16
+}
+
+func (fc *fcgiConn) writeBeginRequest() error {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint16(body[0:2], fcgiRoleResponder)
+	// flags byte (body[2]) left 0: don't keep the connection open past this
+	// request, since each RoundTrip dials its own connection.
+	return fc.writeRecord(fcgiBeginRequest, body)
+}
+
+// writeParams encodes params as FastCGI name-value pairs and writes them as
+// one or more PARAMS records, terminated by the required empty record.
+func (fc *fcgiConn) writeParams(params map[string]string) error {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		value := params[name]
+		writeNameValueLength(&buf, len(name))
+		writeNameValueLength(&buf, len(value))
+		buf.WriteString(name)
+		buf.WriteString(value)
+	}
+	return fc.writeChunked(fcgiParams, buf.Bytes())
+}
+
+func writeNameValueLength(buf *bytes.Buffer, n int) {
+	if n < 128 {
+		buf.WriteByte(byte(n))
+		return
+	}
+	var lenBytes [4]byte
+	binary.BigEndian.PutUint32(lenBytes[:], uint32(n)|0x80000000)
+	buf.Write(lenBytes[:])
+}
+
+// writeStdin streams body as STDIN records no larger than 65535 bytes each,
+// followed by the required empty terminating record.
+func (fc *fcgiConn) writeStdin(body io.ReadCloser) error {
+	if body == nil {
+		return fc.writeRecord(fcgiStdin, nil)
+	}
+	defer body.Close()
+
+	buf := make([]byte, fcgiMaxChunk)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if werr := fc.writeRecord(fcgiStdin, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fc.writeRecord(fcgiStdin, nil)
+}
+
+// writeChunked splits data into records of at most fcgiMaxChunk bytes and
+// writes a final empty record of the same type to terminate the stream.
+func (fc *fcgiConn) writeChunked(recType uint8, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > fcgiMaxChunk {
+			n = fcgiMaxChunk
+		}
+		if err := fc.writeRecord(recType, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return fc.writeRecord(recType, nil)
+}
+
+func (fc *fcgiConn) writeRecord(recType uint8, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	record := make([]byte, fcgiHeaderLen, fcgiHeaderLen+len(content)+padding)
+	record[0] = fcgiVersion1
+	record[1] = recType
+	binary.BigEndian.PutUint16(record[2:4], fc.requestID)
+	binary.BigEndian.PutUint16(record[4:6], uint16(len(content)))
+	record[6] = uint8(padding)
+	record[7] = 0
+	record = append(record, content...)
+	record = append(record, make([]byte, padding)...)
+	_, err := fc.conn.Write(record)
+	return err
+}
+
+func readFcgiRecord(r *bufio.Reader) (fcgiHeader, []byte, error) {
+	raw := make([]byte, fcgiHeaderLen)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return fcgiHeader{}, nil, err
+	}
+	header := fcgiHeader{
+		version:       raw[0],
+		recType:       raw[1],
+		requestID:     binary.BigEndian.Uint16(raw[2:4]),
+		contentLength: binary.BigEndian.Uint16(raw[4:6]),
+		paddingLength: raw[6],
+	}
+	content := make([]byte, header.contentLength)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return header, nil, err
+	}
+	if header.paddingLength > 0 {
+		if _, err := io.CopyN(io.Discard, r, int64(header.paddingLength)); err != nil {
+			return header, nil, err
+		}
+	}
+	return header, content, nil
+}
+
+// readResponse reads STDOUT/STDERR records until END_REQUEST, then parses
+// the CGI-style header block at the start of STDOUT into an *http.Response.
+func (fc *fcgiConn) readResponse(req *http.Request) (*http.Response, error) {
+	r := bufio.NewReader(fc.conn)
+	var stdout, stderr bytes.Buffer
+	for {
+		header, content, err := readFcgiRecord(r)
+		if err != nil {
+			return nil, fmt.Errorf("fastcgi: reading response: %w", err)
+		}
+		switch header.recType {
+		case fcgiStdout:
+			stdout.Write(content)
+		case fcgiStderr:
+			stderr.Write(content)
+		case fcgiEndRequest:
+			if stderr.Len() > 0 {
+				log.Printf("fastcgi: backend stderr: %s", stderr.String())
+			}
+			return parseCGIResponse(req, &stdout)
+		}
+	}
+}
+
+func parseCGIResponse(req *http.Request, stdout *bytes.Buffer) (*http.Response, error) {
+	tp := textproto.NewReader(bufio.NewReader(stdout))
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("fastcgi: parsing response headers: %w", err)
+	}
+
+	statusCode := http.StatusOK
+	if status := mimeHeader.Get("Status"); status != "" {
+		if fields := strings.Fields(status); len(fields) > 0 {
+			if code, err := strconv.Atoi(fields[0]); err == nil {
+				statusCode = code
+			}
+		}
+		mimeHeader.Del("Status")
+	}
+
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode: statusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header(mimeHeader),
+		Body:       io.NopCloser(tp.R),
+		Request:    req,
+	}, nil
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -38,53 +40,237 @@ func WithWeight(weight int) ListenerConfig {
 	}
 }
 
-type Listener struct {
-	id                uuid.UUID
-	targetIp          net.IP
-	targetPort        int
-	httpClient        http.Client
-	healthCheckConfig *ListenerHealthCheckConfig
-	weight            int
-	wg                *sync.WaitGroup
+// WithTransport overrides the http.Transport used to dial the listener's
+// target, letting callers tune connection pooling, dial timeouts, or TLS.
+func WithTransport(transport *http.Transport) ListenerConfig {
+	return func(l *Listener) {
+		l.transport = transport
+	}
 }
 
-func NewListener(targetAddr string, config ...ListenerConfig) (*Listener, error) {
-	ip, port, err := net.SplitHostPort(targetAddr)
-	if err != nil {
-		return nil, &ErrListenerCreate{reason: fmt.Sprintf("unable to parse address %s", targetAddr)}
+// WithFastCGI switches the listener's upstream protocol from HTTP to
+// FastCGI, suitable for proxying directly to PHP-FPM or a Python FastCGI
+// worker. root is the document root used to build SCRIPT_FILENAME, index is
+// the filename appended to a request path that resolves to a directory, and
+// envVars are additional CGI parameters merged into every request.
+func WithFastCGI(root, index string, envVars map[string]string) ListenerConfig {
+	return func(l *Listener) {
+		l.transport = newFastCGITransport(l.network, l.getTargetAddr(), root, index, envVars)
 	}
-	parsedIp := net.ParseIP(ip)
-	if parsedIp == nil {
-		return nil, &ErrListenerCreate{reason: fmt.Sprintf("unable to parse IP address %s", ip)}
+}
+
+// PassiveHealthConfig configures outlier detection based on live traffic,
+// as an early-warning complement to the active healthcheck probe.
+type PassiveHealthConfig struct {
+	consecutiveFailures int
+	window              time.Duration
+	baseCooldown        time.Duration
+	maxCooldown         time.Duration
+}
+
+// WithPassiveHealth ejects a listener once it produces consecutiveFailures
+// failures (transport errors, 5xx responses) in a row, each no more than
+// window after the previous one, without waiting for the next active probe. The ejection cooldown starts at baseCooldown
+// and doubles on each re-ejection, capped at maxCooldown, mirroring Envoy
+// and Traefik style outlier detection.
+func WithPassiveHealth(consecutiveFailures int, window, baseCooldown, maxCooldown time.Duration) ListenerConfig {
+	return func(l *Listener) {
+		l.passiveHealthConfig = &PassiveHealthConfig{
+			consecutiveFailures: consecutiveFailures,
+			window:              window,
+			baseCooldown:        baseCooldown,
+			maxCooldown:         maxCooldown,
+		}
 	}
-	parsedPort, err := strconv.Atoi(port)
-	if err != nil {
-		return nil, &ErrListenerCreate{reason: fmt.Sprintf("unable to convert port %s from string to int", port)}
+}
+
+type Listener struct {
+	id                  uuid.UUID
+	network             string // "tcp" or "unix"
+	targetIp            net.IP
+	targetPort          int
+	targetSocketPath    string
+	httpClient          http.Client
+	healthCheckConfig   *ListenerHealthCheckConfig
+	weight              int
+	wg                  *sync.WaitGroup
+	inflightCount       atomic.Int64
+	transport           http.RoundTripper
+	proxy               *httputil.ReverseProxy
+	healthy             atomic.Bool
+	passiveHealthConfig *PassiveHealthConfig
+	passiveMu           sync.Mutex
+	failureStreak       int
+	lastFailureAt       time.Time
+	cooldown            time.Duration
+	ejectedUntil        time.Time
+}
+
+func NewListener(targetAddr string, config ...ListenerConfig) (*Listener, error) {
+	var l *Listener
+	if socketPath, ok := strings.CutPrefix(targetAddr, "unix://"); ok {
+		l = &Listener{id: uuid.New(), network: "unix", targetSocketPath: socketPath, weight: 1, wg: &sync.WaitGroup{}}
+	} else {
+		ip, port, err := net.SplitHostPort(targetAddr)
+		if err != nil {
+			return nil, &ErrListenerCreate{reason: fmt.Sprintf("unable to parse address %s", targetAddr)}
+		}
+		parsedIp := net.ParseIP(ip)
+		if parsedIp == nil {
+			return nil, &ErrListenerCreate{reason: fmt.Sprintf("unable to parse IP address %s", ip)}
+		}
+		parsedPort, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, &ErrListenerCreate{reason: fmt.Sprintf("unable to convert port %s from string to int", port)}
+		}
+		l = &Listener{id: uuid.New(), network: "tcp", targetIp: parsedIp, targetPort: parsedPort, httpClient: http.Client{}, weight: 1, wg: &sync.WaitGroup{}}
 	}
-	l := &Listener{id: uuid.New(), targetIp: parsedIp, targetPort: parsedPort, httpClient: http.Client{}, weight: 1}
+	l.healthy.Store(true)
 	for _, c := range config {
 		c(l)
 	}
+	if l.transport == nil {
+		l.transport = &http.Transport{
+			MaxIdleConnsPerHost: 10,
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		}
+	}
+	l.proxy = &httputil.ReverseProxy{
+		Transport: l.transport,
+		Director:  l.direct,
+		ModifyResponse: func(resp *http.Response) error {
+			l.recordResult(resp.StatusCode < http.StatusInternalServerError)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			l.recordResult(false)
+			log.Println("error forwarding request", err)
+			http.Error(w, "error forwarding request", http.StatusBadGateway)
+		},
+	}
 	return l, nil
 }
 
+// recordResult feeds a passive health signal from live traffic. It is a
+// no-op unless WithPassiveHealth was configured. A run of
+// consecutiveFailures failures, each no more than window after the previous
+// one and with no success in between, ejects the listener by clearing
+// healthy for a cooldown that doubles on each re-ejection.
+func (l *Listener) recordResult(success bool) {
+	cfg := l.passiveHealthConfig
+	if cfg == nil {
+		return
+	}
+	l.passiveMu.Lock()
+	defer l.passiveMu.Unlock()
+
+	if success {
+		l.failureStreak = 0
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(l.lastFailureAt) > cfg.window {
+		l.failureStreak = 0
+	}
+	l.lastFailureAt = now
+	l.failureStreak++
+	if l.failureStreak < cfg.consecutiveFailures {
+		return
+	}
+	l.failureStreak = 0
+
+	if l.cooldown == 0 {
+		l.cooldown = cfg.baseCooldown
+	} else {
+		l.cooldown *= 2
+		if l.cooldown > cfg.maxCooldown {
+			l.cooldown = cfg.maxCooldown
+		}
+	}
+	cooldown := l.cooldown
+	l.ejectedUntil = time.Now().Add(cooldown)
+	log.Printf("Listener %s ejected by passive health check for %s", l.id, cooldown)
+	l.healthy.Store(false)
+	time.AfterFunc(cooldown, l.recoverFromEjection)
+}
+
+// recoverFromEjection runs when an ejection's cooldown timer fires. A
+// re-ejection that happens before this timer fires pushes l.ejectedUntil
+// further out, so this only restores healthy once the most recent cooldown
+// has actually elapsed; otherwise it's a stale timer from a shorter,
+// already-superseded cooldown and must not undo the newer one.
+func (l *Listener) recoverFromEjection() {
+	l.passiveMu.Lock()
+	defer l.passiveMu.Unlock()
+	if time.Now().After(l.ejectedUntil) {
+		l.healthy.Store(true)
+	}
+}
+
+// acceptActiveProbe reports whether a passing active healthcheck is allowed
+// to mark the listener healthy right now. While a passive ejection cooldown
+// is still running, the active probe (which usually hits a trivial /health
+// endpoint) must not silently undo it; only a failing active probe can still
+// mark the listener unhealthy during that window.
+func (l *Listener) acceptActiveProbe() bool {
+	l.passiveMu.Lock()
+	defer l.passiveMu.Unlock()
+	return time.Now().After(l.ejectedUntil)
+}
+
+// direct rewrites an outbound request to target this listener's backend,
+// preserving the client-facing host/port as X-Forwarded-Host/-Port/-Proto.
+// Hop-by-hop header stripping and X-Forwarded-For are handled by
+// httputil.ReverseProxy itself.
+func (l *Listener) direct(r *http.Request) {
+	originalHost := r.Host
+	r.URL.Scheme = "http"
+	r.URL.Host = l.getTargetAddr()
+	r.Host = l.getTargetAddr()
+	r.Header.Set("X-Forwarded-Host", originalHost)
+	if _, port, err := net.SplitHostPort(originalHost); err == nil {
+		r.Header.Set("X-Forwarded-Port", port)
+	}
+	if r.TLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		r.Header.Set("X-Forwarded-Proto", "http")
+	}
+}
+
 func (l *Listener) getTargetAddr() string {
+	if l.network == "unix" {
+		return l.targetSocketPath
+	}
 	return net.JoinHostPort(l.targetIp.String(), strconv.Itoa(l.targetPort))
 }
 
+// inflight returns the number of requests currently being proxied by this
+// listener, used by balancing algorithms such as LeastConn.
+func (l *Listener) inflight() int64 {
+	return l.inflightCount.Load()
+}
+
 type ListenerHealthcheckResponse struct {
 	err    error
 	status string
 }
 
+// healthcheck runs the active probe and updates l.healthy to match, so it
+// agrees with any ejection made by the passive path in recordResult.
 func (l *Listener) healthcheck() ListenerHealthcheckResponse {
 	if l.healthCheckConfig == nil {
 		log.Println("no healthcheck configured")
+		if l.acceptActiveProbe() {
+			l.healthy.Store(true)
+		}
 		return ListenerHealthcheckResponse{status: "OK", err: nil}
 	}
 	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:%d%s", l.targetIp.String(), l.healthCheckConfig.port, l.healthCheckConfig.path), nil)
 	if err != nil {
 		log.Println("error creating healthcheck request", err)
+		l.healthy.Store(false)
 		return ListenerHealthcheckResponse{status: "ERROR", err: err}
 	}
 
@@ -92,47 +278,25 @@ func (l *Listener) healthcheck() ListenerHealthcheckResponse {
 	resp, err := l.httpClient.Do(req)
 	if err != nil {
 		log.Println("error sending healthcheck request", err)
+		l.healthy.Store(false)
 		return ListenerHealthcheckResponse{status: "ERROR", err: err}
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		log.Println("healthcheck failed with status", resp.StatusCode)
+		l.healthy.Store(false)
 		return ListenerHealthcheckResponse{status: "ERROR", err: fmt.Errorf("healthcheck failed with status %d", resp.StatusCode)}
 	}
+	if l.acceptActiveProbe() {
+		l.healthy.Store(true)
+	}
 	return ListenerHealthcheckResponse{status: "OK", err: nil}
 }
 
 func (l *Listener) handle(w http.ResponseWriter, r *http.Request) {
 	l.wg.Add(1)
+	l.inflightCount.Add(1)
 	defer l.wg.Done()
-	proxyReq, err := http.NewRequest(r.Method, fmt.Sprintf("http://%s", l.getTargetAddr()), r.Body)
-	if err != nil {
-		log.Println("error creating forwarded request", err)
-		http.Error(w, "unable to create forwarded request", http.StatusInternalServerError)
-		return
-	}
-	// Copy original headers
-	proxyReq.Header = r.Header
-	// Append X-Forwarded-For header
-	if r.Header.Get("X-Forwarded-For") != "" {
-		proxyReq.Header.Set("X-Forwarded-For", r.Header.Get("X-Forwarded-For")+","+r.RemoteAddr)
-	} else {
-		proxyReq.Header.Set("X-Forwarded-For", r.RemoteAddr)
-	}
-	// Update X-Forwarded-Port header
-	_, connectedLoadBalancerPort, err := net.SplitHostPort(r.Host)
-	if err != nil {
-		log.Println("error setting X-Forwarded-Port header", err)
-		http.Error(w, "unable to create forwarded request", http.StatusInternalServerError)
-		return
-	}
-	proxyReq.Header.Set("X-Forwarded-Port", connectedLoadBalancerPort)
-	resp, err := l.httpClient.Do(proxyReq)
-	if err != nil {
-		http.Error(w, "error forwarding request", http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	// Return response from target server to client
-	io.Copy(w, resp.Body)
+	defer l.inflightCount.Add(-1)
+	l.proxy.ServeHTTP(w, r)
 }
@@ -63,7 +63,8 @@ func main() {
 	}
 
 	mainServerMux := http.NewServeMux()
-	// TODO: allow loadbalancer to service different domains
+	// Additional domains/paths can be serviced by registering more routes
+	// via loadbalancer.AddRoute before the main server starts serving.
 	mainServerMux.HandleFunc("/", loadbalancer.handle)
 	mainServer := &http.Server{Addr: loadbalancerAddr, Handler: mainServerMux}
 	go mainServer.ListenAndServe()
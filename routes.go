@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Route binds a host/path match to a pool of listeners that share a
+// balancing algorithm, so a single Server can front multiple backend pools
+// on one bind port (virtual hosts, path-based routing, or both).
+//
+// Host may be an exact hostname, a wildcard of the form "*.example.com", or
+// empty to match any host. PathPrefix may be empty to match any path.
+type Route struct {
+	Host       string
+	PathPrefix string
+	Listeners  []*Listener
+	Algorithm  BalancingAlgorithm
+}
+
+func newRoute() *Route {
+	return &Route{}
+}
+
+func (route *Route) algorithm() BalancingAlgorithm {
+	if route.Algorithm != nil {
+		return route.Algorithm
+	}
+	return DefaultBalancingAlgorithm
+}
+
+// hostMatches reports whether host satisfies pattern, where pattern is an
+// exact hostname, a "*.example.com" wildcard, or empty/"*" to match anything.
+func hostMatches(pattern, host string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// hostSpecificity ranks a route's Host pattern for matchRoute: a catch-all
+// (empty or "*") is least specific, a "*.example.com" wildcard is more
+// specific than that, and an exact hostname is most specific of all.
+func hostSpecificity(pattern string) int {
+	switch {
+	case pattern == "" || pattern == "*":
+		return 0
+	case strings.HasPrefix(pattern, "*."):
+		return 1
+	default:
+		return 2
+	}
+}
+
+// matchRoute finds the most specific route for r: a more specific Host
+// pattern (exact beats wildcard beats catch-all) wins regardless of path, and
+// within the same specificity tier the longest path prefix wins. If nothing
+// matches, the server's default pool is returned.
+func (s *Server) matchRoute(r *http.Request) *Route {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	best := s.defaultRoute
+	bestSpecificity := -1
+	bestPrefixLen := -1
+	for _, route := range s.routes {
+		if !hostMatches(route.Host, host) || !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+			continue
+		}
+		specificity := hostSpecificity(route.Host)
+		prefixLen := len(route.PathPrefix)
+		if specificity < bestSpecificity {
+			continue
+		}
+		if specificity == bestSpecificity && prefixLen <= bestPrefixLen {
+			continue
+		}
+		best, bestSpecificity, bestPrefixLen = route, specificity, prefixLen
+	}
+	return best
+}
@@ -1,52 +1,246 @@
 package main
 
 import (
+	crand "crypto/rand"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math/big"
 	"math/rand"
 	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
-type BalancingAlgorithm func([]*Listener) *Listener
+// processRand is seeded from crypto/rand once per process so that, e.g., the
+// initial listener ordering differs across short-lived processes instead of
+// always favoring the first few listeners added.
+var processRand = newProcessRand()
 
-func (b BalancingAlgorithm) pickListener(listeners []*Listener) (*Listener, error) {
+func newProcessRand() *rand.Rand {
+	seed, err := crand.Int(crand.Reader, big.NewInt(0).SetInt64(1<<62))
+	if err != nil {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return rand.New(rand.NewSource(seed.Int64()))
+}
+
+// shuffleListeners randomizes listeners in place so deterministic algorithms
+// like RoundRobin don't always start from the same backend across processes.
+func shuffleListeners(listeners []*Listener) {
+	processRand.Shuffle(len(listeners), func(i, j int) {
+		listeners[i], listeners[j] = listeners[j], listeners[i]
+	})
+}
+
+// healthyOrAll narrows listeners down to the ones currently marked healthy,
+// so a balancing algorithm never deterministically keeps picking a listener
+// Server.handle's retry loop has already ruled out. If none are healthy, the
+// full list is returned unchanged so callers still have something to try.
+func healthyOrAll(listeners []*Listener) []*Listener {
+	healthy := make([]*Listener, 0, len(listeners))
+	for _, listener := range listeners {
+		if listener.healthy.Load() {
+			healthy = append(healthy, listener)
+		}
+	}
+	if len(healthy) == 0 {
+		return listeners
+	}
+	return healthy
+}
+
+type BalancingAlgorithm func(listeners []*Listener, r *http.Request) *Listener
+
+func (b BalancingAlgorithm) pickListener(listeners []*Listener, r *http.Request) (*Listener, error) {
 	if len(listeners) == 0 {
 		return nil, &ErrServerGenericError{reason: "no listeners available"}
 	}
-	return b(listeners), nil
+	return b(listeners, r), nil
 }
 
 var DefaultBalancingAlgorithm = Random()
 
 func Random() BalancingAlgorithm {
-	return func(listeners []*Listener) *Listener {
+	return func(listeners []*Listener, r *http.Request) *Listener {
+		listeners = healthyOrAll(listeners)
 		return listeners[rand.Intn(len(listeners))]
 	}
 }
 
 func RoundRobin() BalancingAlgorithm {
 	var i int
-	return func(listeners []*Listener) *Listener {
+	return func(listeners []*Listener, r *http.Request) *Listener {
 		i = (i + 1) % len(listeners)
 		return listeners[i]
 	}
 }
 
 func WeightedRoundRobin() BalancingAlgorithm {
-	return func(listeners []*Listener) *Listener {
-		// Simple algorithm that flattens the list of listeners by their weight
-		// and then picks a random listener from the flattened list.
-		// Not the most space-efficient algorithm, but it's simple and works.
-		flatSlice := make([]int, 0)
-		for i, listener := range listeners {
-			for j := 0; j < listener.weight; j++ {
-				flatSlice = append(flatSlice, i)
+	var mu sync.Mutex
+	var cachedHash uint32
+	var prefixSums []int
+	var totalWeight int
+
+	return func(listeners []*Listener, r *http.Request) *Listener {
+		listeners = healthyOrAll(listeners)
+		setHash := listenerSetHash(listeners)
+
+		mu.Lock()
+		if prefixSums == nil || setHash != cachedHash {
+			prefixSums = make([]int, len(listeners))
+			sum := 0
+			for i, listener := range listeners {
+				sum += listener.weight
+				prefixSums[i] = sum
+			}
+			totalWeight = sum
+			cachedHash = setHash
+		}
+		sums, total := prefixSums, totalWeight
+		mu.Unlock()
+
+		target := rand.Intn(total) + 1
+		idx := sort.Search(len(sums), func(i int) bool { return sums[i] >= target })
+		return listeners[idx]
+	}
+}
+
+// hashString returns the FNV-1a digest of s, used as the hashing primitive
+// for the request-aware balancing algorithms below.
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// IPHash picks a listener by hashing the client's IP address, giving a
+// client session-sticky placement as long as the listener set is stable.
+func IPHash() BalancingAlgorithm {
+	return func(listeners []*Listener, r *http.Request) *Listener {
+		listeners = healthyOrAll(listeners)
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		return listeners[hashString(host)%uint32(len(listeners))]
+	}
+}
+
+// URIHash picks a listener by hashing the request URI, so repeat requests
+// for the same resource land on the same backend.
+func URIHash() BalancingAlgorithm {
+	return func(listeners []*Listener, r *http.Request) *Listener {
+		listeners = healthyOrAll(listeners)
+		return listeners[hashString(r.URL.RequestURI())%uint32(len(listeners))]
+	}
+}
+
+// HeaderHash picks a listener by hashing the named request header.
+func HeaderHash(name string) BalancingAlgorithm {
+	return func(listeners []*Listener, r *http.Request) *Listener {
+		listeners = healthyOrAll(listeners)
+		return listeners[hashString(r.Header.Get(name))%uint32(len(listeners))]
+	}
+}
+
+// LeastConn picks the listener with the fewest in-flight requests, breaking
+// ties randomly.
+func LeastConn() BalancingAlgorithm {
+	return func(listeners []*Listener, r *http.Request) *Listener {
+		listeners = healthyOrAll(listeners)
+		best := make([]*Listener, 0, 1)
+		min := int64(-1)
+		for _, listener := range listeners {
+			n := listener.inflight()
+			switch {
+			case min == -1 || n < min:
+				min = n
+				best = best[:0]
+				best = append(best, listener)
+			case n == min:
+				best = append(best, listener)
+			}
+		}
+		return best[rand.Intn(len(best))]
+	}
+}
+
+// FirstAvailable returns the first healthy listener in declared order,
+// falling back to the first listener if none are healthy, making it
+// suitable for a primary/backup topology.
+func FirstAvailable() BalancingAlgorithm {
+	return func(listeners []*Listener, r *http.Request) *Listener {
+		for _, listener := range listeners {
+			if listener.healthy.Load() {
+				return listener
 			}
 		}
-		return listeners[flatSlice[rand.Intn(len(flatSlice))]]
+		return listeners[0]
+	}
+}
+
+// hashRing is a sorted set of virtual nodes used by ConsistentHash.
+type hashRing struct {
+	points  []uint32
+	byPoint map[uint32]*Listener
+}
+
+func buildHashRing(listeners []*Listener, replicas int) *hashRing {
+	ring := &hashRing{byPoint: make(map[uint32]*Listener, replicas*len(listeners))}
+	for _, listener := range listeners {
+		for i := 0; i < replicas; i++ {
+			point := hashString(fmt.Sprintf("%s-%d", listener.id, i))
+			ring.points = append(ring.points, point)
+			ring.byPoint[point] = listener
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// listenerSetHash hashes the set of listener ids so ConsistentHash can
+// detect when the healthy listener set changes and the ring needs rebuilding.
+func listenerSetHash(listeners []*Listener) uint32 {
+	ids := make([]string, len(listeners))
+	for i, listener := range listeners {
+		ids[i] = listener.id.String()
+	}
+	sort.Strings(ids)
+	return hashString(strings.Join(ids, ","))
+}
+
+// ConsistentHash places listeners on a hash ring of replicas*len(listeners)
+// virtual nodes keyed on listener id, so adding or removing a backend only
+// remaps roughly 1/N of keys instead of reshuffling everything. The ring is
+// rebuilt lazily, only when the healthy listener set actually changes.
+func ConsistentHash(replicas int) BalancingAlgorithm {
+	var mu sync.Mutex
+	var cachedHash uint32
+	var cachedRing *hashRing
+
+	return func(listeners []*Listener, r *http.Request) *Listener {
+		listeners = healthyOrAll(listeners)
+		setHash := listenerSetHash(listeners)
+
+		mu.Lock()
+		if cachedRing == nil || setHash != cachedHash {
+			cachedRing = buildHashRing(listeners, replicas)
+			cachedHash = setHash
+		}
+		ring := cachedRing
+		mu.Unlock()
+
+		point := hashString(r.URL.RequestURI())
+		idx := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= point })
+		if idx == len(ring.points) {
+			idx = 0
+		}
+		return ring.byPoint[ring.points[idx]]
 	}
 }
 
@@ -54,16 +248,16 @@ type ServerConfig func(*Server)
 
 func WithBalancingAlgorithm(b BalancingAlgorithm) ServerConfig {
 	return func(s *Server) {
-		s.balancingAlgorithm = b
+		s.defaultRoute.Algorithm = b
 	}
 }
 
 type Server struct {
-	listeners          []*Listener
-	unhealthyListeners map[string]bool
-	ip                 net.IP
-	stopped            atomic.Bool
-	balancingAlgorithm BalancingAlgorithm
+	defaultRoute *Route
+	routes       []*Route
+	ip           net.IP
+	stopped      atomic.Bool
+	healthWG     sync.WaitGroup
 }
 
 func NewServer(addr string, config ...ServerConfig) (*Server, error) {
@@ -76,48 +270,97 @@ func NewServer(addr string, config ...ServerConfig) (*Server, error) {
 		return nil, &ErrServerCreate{reason: fmt.Sprintf("unable to parse ip %s", ip)}
 	}
 
-	s := &Server{ip: parsedIp}
+	s := &Server{ip: parsedIp, defaultRoute: newRoute()}
 	for _, c := range config {
 		c(s)
 	}
-	if s.balancingAlgorithm == nil {
-		s.balancingAlgorithm = DefaultBalancingAlgorithm
-	}
 	return s, nil
 }
 
+// AddListener adds listener to the server's default pool, used when the
+// server fronts a single backend without host/path routing. The listener's
+// health-check loop starts immediately, regardless of whether Start has been
+// called yet, so listeners added after Start still get probed; its first
+// probe runs after one jittered interval.
 func (s *Server) AddListener(listener *Listener) {
 	log.Println("Adding new listener to listen on", listener.getTargetAddr())
-	s.listeners = append(s.listeners, listener)
+	s.defaultRoute.Listeners = append(s.defaultRoute.Listeners, listener)
+	shuffleListeners(s.defaultRoute.Listeners)
+	s.startHealthcheck(listener)
 }
 
-func (s *Server) healthcheck() {
-	if len(s.listeners) == 0 {
-		log.Println("No listeners available")
-		return
+// AddRoute registers a host/path routed pool of listeners. Requests whose
+// Host header and URL path match the route are balanced across its own
+// listeners using its own algorithm, independently of every other route. Each
+// listener's health-check loop starts immediately, regardless of whether Start
+// has been called yet; its first probe runs after one jittered interval.
+func (s *Server) AddRoute(route Route) {
+	shuffleListeners(route.Listeners)
+	s.routes = append(s.routes, &route)
+	for _, listener := range route.Listeners {
+		s.startHealthcheck(listener)
 	}
-	for _, listener := range s.listeners {
-		go func() {
-			response := listener.healthcheck()
-			if response.err != nil {
-				log.Printf("Listener %s is unhealthy: %s", listener.id, response.err)
-				s.unhealthyListeners[listener.id.String()] = true
-			} else {
-				log.Printf("Listener %s is healthy", listener.id)
-				delete(s.unhealthyListeners, listener.id.String())
-			}
-		}()
+}
+
+// startHealthcheck spawns the health-check loop for listener, tracked by
+// healthWG so Start can block until the server is stopped.
+func (s *Server) startHealthcheck(listener *Listener) {
+	s.healthWG.Add(1)
+	go func() {
+		defer s.healthWG.Done()
+		s.runHealthcheck(listener)
+	}()
+}
+
+func (s *Server) pools() []*Route {
+	return append([]*Route{s.defaultRoute}, s.routes...)
+}
+
+// defaultHealthCheckInterval is the base period between active probes of a
+// listener, before jitter is applied.
+const defaultHealthCheckInterval = 5 * time.Second
+
+// healthCheckJitter returns base adjusted by up to ±20%, so that listeners
+// started around the same time don't all probe their backends in lockstep.
+func healthCheckJitter(base time.Duration) time.Duration {
+	spread := float64(base) * 0.2
+	delta := (rand.Float64()*2 - 1) * spread
+	return base + time.Duration(delta)
+}
+
+// runHealthcheck probes listener on its own jittered ticker until the server
+// is stopped, so a fleet of listeners doesn't thunder against their backends
+// in a single synchronized fan-out every interval.
+func (s *Server) runHealthcheck(listener *Listener) {
+	ticker := time.NewTicker(healthCheckJitter(defaultHealthCheckInterval))
+	defer ticker.Stop()
+	for !s.stopped.Load() {
+		<-ticker.C
+		if s.stopped.Load() {
+			return
+		}
+		response := listener.healthcheck()
+		if response.err != nil {
+			log.Printf("Listener %s is unhealthy: %s", listener.id, response.err)
+		} else {
+			log.Printf("Listener %s is healthy", listener.id)
+		}
+		ticker.Reset(healthCheckJitter(defaultHealthCheckInterval))
 	}
 }
 
+// Start blocks until Stop is called, then waits for every listener's
+// health-check loop to exit. Listeners already added when Start is called and any added later via
+// AddListener/AddRoute are both covered, since each spawns its own
+// health-check goroutine as soon as it's added.
 func (s *Server) Start() error {
 	if s.stopped.Load() {
 		return &ErrServerStopped{}
 	}
 	for !s.stopped.Load() {
-		s.healthcheck()
-		time.Sleep(5 * time.Second)
+		time.Sleep(100 * time.Millisecond)
 	}
+	s.healthWG.Wait()
 	return nil
 }
 
@@ -128,8 +371,10 @@ func (s *Server) Stop() error {
 	log.Println("Stopping server")
 	s.stopped.Store(true)
 	log.Println("Waiting for listeners to stop")
-	for _, listener := range s.listeners {
-		listener.wg.Wait()
+	for _, route := range s.pools() {
+		for _, listener := range route.Listeners {
+			listener.wg.Wait()
+		}
 	}
 	log.Println("Server stopped")
 	return nil
@@ -140,19 +385,25 @@ func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "server is stopped", http.StatusServiceUnavailable)
 		return
 	}
+	route := s.matchRoute(r)
 	var listener *Listener
-	// Note: even with the check, there is no guarantee that the listener
-	// selected is healthy. This is because the healthcheck is done in a
-	// separate goroutine and the listener may only be marked unhealthy
-	// after the healthcheck
-	for listener == nil || s.unhealthyListeners[listener.id.String()] {
-		selected, err := s.balancingAlgorithm.pickListener(s.listeners)
+	// Active and passive health checks both write to Listener.healthy, so a
+	// single bounded pass over the pool is enough: if every listener is
+	// unhealthy we give up instead of spinning forever.
+	for attempts := 0; listener == nil && attempts < len(route.Listeners); attempts++ {
+		selected, err := route.algorithm().pickListener(route.Listeners, r)
 		if err != nil {
 			log.Printf("Error selecting listener: %s", err)
 			http.Error(w, "load balancer internal error", http.StatusServiceUnavailable)
 			return
 		}
-		listener = selected
+		if selected.healthy.Load() {
+			listener = selected
+		}
+	}
+	if listener == nil {
+		http.Error(w, "no healthy listeners available", http.StatusServiceUnavailable)
+		return
 	}
 
 	log.Printf("Request handled by listener %s", listener.id)